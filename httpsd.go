@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// sdCache holds the most recently resolved target groups per Exporter, keyed by
+// Exporter name, so the HTTP SD handler can serve them without touching PuppetDB.
+var sdCache = struct {
+	sync.RWMutex
+	groups map[string][]Targets
+}{groups: make(map[string][]Targets)}
+
+// updateSDCache replaces the cached target groups for an Exporter
+func updateSDCache(exporter string, targets []Targets) {
+	sdCache.Lock()
+	defer sdCache.Unlock()
+	sdCache.groups[exporter] = targets
+}
+
+// pruneSDCache removes cached target groups for exporters no longer present in the
+// current role mapping, so an exporter removed from role-mapping.yaml stops being served
+// at /sd instead of lingering in the cache indefinitely.
+func pruneSDCache(exporters []string) {
+	keep := make(map[string]bool, len(exporters))
+	for _, exporter := range exporters {
+		keep[exporter] = true
+	}
+
+	sdCache.Lock()
+	defer sdCache.Unlock()
+	for exporter := range sdCache.groups {
+		if !keep[exporter] {
+			delete(sdCache.groups, exporter)
+		}
+	}
+}
+
+// serveHTTPSD starts an HTTP server exposing the cached target groups in Prometheus's
+// http_sd_config JSON format at /sd, so prometheus-puppetdb can be used as a sidecar
+// without a shared volume with Prometheus.
+func serveHTTPSD(listenAddress string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sd", handleSD)
+
+	fmt.Printf("Serving HTTP service discovery on %s\n", listenAddress)
+	err := http.ListenAndServe(listenAddress, mux)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handleSD(w http.ResponseWriter, r *http.Request) {
+	sdCache.RLock()
+	allTargets := []Targets{}
+	for _, targets := range sdCache.groups {
+		allTargets = append(allTargets, targets...)
+	}
+	sdCache.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(allTargets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+// TestPruneSDCache verifies that an exporter removed from the role mapping is dropped from
+// the cache instead of being served at /sd indefinitely.
+func TestPruneSDCache(t *testing.T) {
+	sdCache.Lock()
+	sdCache.groups = map[string][]Targets{
+		"node-exporter": {{Targets: []string{"10.0.0.1:9100"}}},
+		"removed-exporter": {{Targets: []string{"10.0.0.2:9200"}}},
+	}
+	sdCache.Unlock()
+
+	pruneSDCache([]string{"node-exporter"})
+
+	sdCache.RLock()
+	defer sdCache.RUnlock()
+	if _, ok := sdCache.groups["removed-exporter"]; ok {
+		t.Error("expected removed-exporter to be pruned from the cache")
+	}
+	if _, ok := sdCache.groups["node-exporter"]; !ok {
+		t.Error("expected node-exporter to remain in the cache")
+	}
+}
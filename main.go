@@ -4,15 +4,12 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -24,23 +21,39 @@ var version = "undefined"
 var transport *http.Transport
 
 type Config struct {
-	Version         bool   `short:"V" long:"version" description:"Display version."`
-	PuppetDBURL     string `short:"u" long:"puppetdb-url" description:"PuppetDB base URL." env:"PROMETHEUS_PUPPETDB_URL" default:"http://puppetdb:8080"`
-	CertFile        string `short:"x" long:"cert-file" description:"A PEM encoded certificate file." env:"PROMETHEUS_CERT_FILE" default:"certs/client.pem"`
-	KeyFile         string `short:"y" long:"key-file" description:"A PEM encoded private key file." env:"PROMETHEUS_KEY_FILE" default:"certs/client.key"`
-	CACertFile      string `short:"z" long:"cacert-file" description:"A PEM encoded CA's certificate file." env:"PROMETHEUS_CACERT_FILE" default:"certs/cacert.pem"`
-	SSLSkipVerify   bool   `short:"k" long:"ssl-skip-verify" description:"Skip SSL verification." env:"PROMETHEUS_SSL_SKIP_VERIFY"`
-	Query           string `short:"q" long:"puppetdb-query" description:"PuppetDB query." env:"PROMETHEUS_PUPPETDB_QUERY" default:"facts[certname, value]"`
-	Filter          string `short:"f" long:"puppetdb-filter" description:"PuppetDB filter." env:"PROMETHEUS_PUPPETDB_FILTER" default:"name='ipaddress' and nodes { deactivated is null }"`
-	RoleMappingFile string `short:"r" long:"role-mapping-file" description:"Role mapping configuration file" env:"PROMETHEUS_ROLE_MAPPING_FILE" default:"role-mapping.yaml"`
-	TargetsDir      string `short:"c" long:"targets-dir" description:"Directory to store File SD targets files." env:"PROMETHEUS_TARGETS_DIR" default:"/etc/prometheus/targets"`
-	Sleep           string `short:"s" long:"sleep" description:"Sleep time between queries." env:"PROMETHEUS_PUPPETDB_SLEEP" default:"60s"`
-	Manpage         bool   `short:"m" long:"manpage" description:"Output manpage."`
+	Version              bool   `short:"V" long:"version" description:"Display version."`
+	PuppetDBURL          string `short:"u" long:"puppetdb-url" description:"PuppetDB base URL." env:"PROMETHEUS_PUPPETDB_URL" default:"http://puppetdb:8080"`
+	CertFile             string `short:"x" long:"cert-file" description:"A PEM encoded certificate file." env:"PROMETHEUS_CERT_FILE" default:"certs/client.pem"`
+	KeyFile              string `short:"y" long:"key-file" description:"A PEM encoded private key file." env:"PROMETHEUS_KEY_FILE" default:"certs/client.key"`
+	CACertFile           string `short:"z" long:"cacert-file" description:"A PEM encoded CA's certificate file." env:"PROMETHEUS_CACERT_FILE" default:"certs/cacert.pem"`
+	SSLSkipVerify        bool   `short:"k" long:"ssl-skip-verify" description:"Skip SSL verification." env:"PROMETHEUS_SSL_SKIP_VERIFY"`
+	Filter               string `short:"f" long:"puppetdb-filter" description:"PuppetDB filter." env:"PROMETHEUS_PUPPETDB_FILTER" default:"nodes { deactivated is null }"`
+	RoleMappingFile      string `short:"r" long:"role-mapping-file" description:"Role mapping configuration file" env:"PROMETHEUS_ROLE_MAPPING_FILE" default:"role-mapping.yaml"`
+	TargetsDir           string `short:"c" long:"targets-dir" description:"Directory to store File SD targets files." env:"PROMETHEUS_TARGETS_DIR" default:"/etc/prometheus/targets"`
+	ListenAddress        string `short:"l" long:"listen-address" description:"Address to listen on for the HTTP service discovery endpoint. When set, target groups are served from memory at /sd instead of being written to TargetsDir." env:"PROMETHEUS_LISTEN_ADDRESS"`
+	MetricsListenAddress string `long:"metrics-listen-address" description:"Address to listen on for Prometheus metrics about prometheus-puppetdb itself." env:"PROMETHEUS_METRICS_LISTEN_ADDRESS" default:":9120"`
+	Sleep                string `short:"s" long:"sleep" description:"Sleep time between queries." env:"PROMETHEUS_PUPPETDB_SLEEP" default:"60s"`
+	Manpage              bool   `short:"m" long:"manpage" description:"Output manpage."`
 }
 
 type Node struct {
 	Certname  string `json:"certname"`
 	Ipaddress string `json:"value"`
+
+	// Meta holds additional __meta_puppetdb_* labels discovered alongside the node,
+	// e.g. resource metadata when QueryType is "resources".
+	Meta map[string]string `json:"-"`
+
+	// Labels holds the values of a RoleMapping's label_facts, keyed by fact name, to be
+	// emitted as target labels as-is.
+	Labels map[string]string `json:"-"`
+}
+
+// ResourceSpec identifies a PuppetDB resource to discover targets from, e.g.
+// {Type: "Package", Title: "prometheus-node-exporter"}.
+type ResourceSpec struct {
+	Type  string `yaml:"type"`
+	Title string `yaml:"title"`
 }
 
 type RoleMapping struct {
@@ -49,11 +62,27 @@ type RoleMapping struct {
 	Path     string   `yaml:"path"`
 	Scheme   string   `yaml:"scheme"`
 	Roles    []string `yaml:"roles"`
-}
 
-type Targets struct {
-	Targets []string          `yaml:"targets"`
-	Labels  map[string]string `yaml:"labels"`
+	// QueryType selects how this mapping discovers nodes: "facts" (default) looks up
+	// nodes via the `role` fact, "resources" looks up nodes via exported/declared
+	// PuppetDB resources.
+	QueryType string         `yaml:"query_type"`
+	Resources []ResourceSpec `yaml:"resources"`
+
+	// AddressFact is the fact used as the target's scrape address, defaulting to
+	// "ipaddress". For "facts" mappings it is fetched in the same query as the role
+	// fact; for "resources" mappings, which carry no address of their own, it is looked
+	// up separately per discovered certname. LabelFacts are additional facts fetched in
+	// the same query and emitted as target labels, keyed by fact name (facts mappings
+	// only).
+	AddressFact string   `yaml:"address_fact"`
+	LabelFacts  []string `yaml:"label_facts"`
+
+	// RelabelConfigs are evaluated per-target, after fact/resource lookup, using
+	// Prometheus relabeling semantics over the target's labels (job, certname,
+	// metrics_path, scheme, label_facts, and for "resources" mappings the
+	// __meta_puppetdb_* labels).
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
 }
 
 func main() {
@@ -106,8 +135,21 @@ func main() {
 	// Setup the http client
 	client := &http.Client{Transport: transport}
 
+	// If a listen address is configured, serve target groups from memory instead of
+	// writing them to TargetsDir, so prometheus-puppetdb can run as a sidecar/service
+	// without a shared volume with Prometheus.
+	if cfg.ListenAddress != "" {
+		go serveHTTPSD(cfg.ListenAddress)
+	}
+
+	// Serve Prometheus metrics about prometheus-puppetdb itself
+	go serveMetrics(cfg.MetricsListenAddress)
+
 	// Start the main loop
 	for {
+		refreshStart := time.Now()
+		refreshFailed := false
+
 		// Read the role mapping from configuration file
 		roleMapping, err := loadRoleMapping(cfg.RoleMappingFile)
 		if err != nil {
@@ -115,36 +157,84 @@ func main() {
 			os.Exit(1)
 		}
 
-		// Clean the targets directory, remove any target files that are no longer listed in Role Mapping
-		err = cleanupTargetsDir(cfg.TargetsDir, roleMapping)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		if cfg.ListenAddress == "" {
+			// Clean the targets directory, remove any target files that are no longer listed in Role Mapping
+			err = cleanupTargetsDir(cfg.TargetsDir, roleMapping)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else {
+			// Prune the in-memory SD cache of any exporter no longer listed in Role Mapping
+			exporters := make([]string, len(roleMapping))
+			for i := range roleMapping {
+				exporters[i] = roleMapping[i].Exporter
+			}
+			pruneSDCache(exporters)
 		}
 
 		// Iterate through the Exporters
 		for e := range roleMapping {
 			var nodes []Node
-			// Iterate through the Roles mapped to each Exporter
-			for r := range roleMapping[e].Roles {
-				var tmpNodes []Node
-				// Get the nodes for this role
-				tmpNodes, err = getNodes(client, cfg.PuppetDBURL, cfg.Query, cfg.Filter, roleMapping[e].Roles[r])
-				if err != nil {
-					fmt.Println(err)
+
+			if roleMapping[e].QueryType == "resources" {
+				// Iterate through the Resources mapped to each Exporter
+				for _, resource := range roleMapping[e].Resources {
+					var tmpNodes []Node
+					tmpNodes, err = getNodesByResource(client, cfg.PuppetDBURL, resource.Type, resource.Title, roleMapping[e].AddressFact)
+					if err != nil {
+						fmt.Println(err)
+						refreshFailed = true
+						break
+					}
+					nodes = append(nodes, tmpNodes...)
+				}
+			} else {
+				// Iterate through the Roles mapped to each Exporter
+				for r := range roleMapping[e].Roles {
+					var tmpNodes []Node
+					// Get the nodes for this role
+					tmpNodes, err = getNodesByFact(client, cfg.PuppetDBURL, cfg.Filter, roleMapping[e].Roles[r], roleMapping[e].AddressFact, roleMapping[e].LabelFacts)
+					if err != nil {
+						fmt.Println(err)
+						refreshFailed = true
+						break
+					}
+					nodes = append(nodes, tmpNodes...)
+				}
+			}
+
+			sdTargets.WithLabelValues(roleMapping[e].Exporter).Set(float64(len(nodes)))
+
+			if cfg.ListenAddress != "" {
+				// Update the in-memory cache served by the HTTP SD endpoint
+				targets, buildErr := buildTargets(nodes, roleMapping[e].Port, roleMapping[e].Path, roleMapping[e].Scheme, roleMapping[e].Exporter, roleMapping[e].RelabelConfigs)
+				if buildErr != nil {
+					fmt.Println(buildErr)
+					refreshFailed = true
 					break
 				}
-				nodes = append(nodes, tmpNodes...)
+				updateSDCache(roleMapping[e].Exporter, targets)
+				continue
 			}
 
-			// Write the nodes to a Targets file per Exporter (==Job)
-			err = writeNodes(nodes, roleMapping[e].Port, roleMapping[e].Path, roleMapping[e].Scheme, roleMapping[e].Exporter, cfg.TargetsDir)
+			// Write the nodes to a Targets file per Exporter (==Job), skipping the write
+			// entirely when the resolved set hasn't changed
+			err = writeNodes(nodes, roleMapping[e].Port, roleMapping[e].Path, roleMapping[e].Scheme, roleMapping[e].Exporter, cfg.TargetsDir, roleMapping[e].RelabelConfigs)
 			if err != nil {
 				fmt.Println(err)
+				refreshFailed = true
 				break
 			}
 		}
 
+		refreshDuration.Observe(time.Since(refreshStart).Seconds())
+		if refreshFailed {
+			refreshFailures.Inc()
+		} else {
+			lastSuccess.Set(float64(time.Now().Unix()))
+		}
+
 		// Sleep...
 		sleep, err := time.ParseDuration(cfg.Sleep)
 		if err != nil {
@@ -188,92 +278,11 @@ func loadRoleMapping(mappingFile string) (roleMapping []RoleMapping, err error)
 		return
 	}
 
-	return
-}
-
-// Iterate through the yml & yaml files in TargetsDir and remove all that do not match an Exporter in roleMapping
-func cleanupTargetsDir(dir string, roles []RoleMapping) (err error) {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-OUTER:
-	for _, file := range files {
-		for r := range roles {
-			found, _ := regexp.MatchString(fmt.Sprintf("%s.(yaml|yml)", roles[r].Exporter), file.Name())
-			if found {
-				continue OUTER
-			}
+	for i := range roleMapping {
+		if roleMapping[i].AddressFact == "" {
+			roleMapping[i].AddressFact = "ipaddress"
 		}
-
-		err = os.Remove(fmt.Sprintf("%s/%s", dir, file.Name()))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-	return
-}
-
-func getNodes(client *http.Client, puppetdb string, query string, filter string, role string) (nodes []Node, err error) {
-	// This was temporary hack
-	//q := fmt.Sprintf("facts[certname,value] {name='ipaddress' and nodes { deactivated is null } and facts { name='role' and value='%s' } }", role)
-
-	// Build the query from Query, Filter and the role
-	q := fmt.Sprintf("%s {%s and facts { name='role' and value='%s' } }", query, filter, role)
-
-	form := strings.NewReader(fmt.Sprintf("{\"query\":\"%s\"}", q))
-	puppetdbURL := fmt.Sprintf("%s/pdb/query/v4", puppetdb)
-	req, err := http.NewRequest("POST", puppetdbURL, form)
-	if err != nil {
-		return
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
 	}
 
-	err = json.Unmarshal(body, &nodes)
-
 	return
 }
-
-func writeNodes(nodes []Node, port int, path string, scheme string, job string, dir string) (err error) {
-	allTargets := []Targets{}
-
-	for _, node := range nodes {
-		targets := Targets{}
-
-		target := fmt.Sprintf("%s:%v", node.Ipaddress, port)
-		targets.Targets = append(targets.Targets, target)
-		targets.Labels = map[string]string{
-			"job":          job,
-			"certname":     node.Certname,
-			"metrics_path": path,
-			"scheme":       scheme,
-		}
-		allTargets = append(allTargets, targets)
-	}
-
-	d, err := yaml.Marshal(&allTargets)
-	if err != nil {
-		return
-	}
-
-	os.MkdirAll(fmt.Sprintf("%s", dir), 0755)
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s.yml", dir, job), d, 0644)
-	if err != nil {
-		return
-	}
-
-	return nil
-}
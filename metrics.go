@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	refreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "puppetdb_sd_refresh_duration_seconds",
+		Help: "Time spent refreshing targets from PuppetDB.",
+	})
+
+	refreshFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "puppetdb_sd_refresh_failures_total",
+		Help: "Number of PuppetDB target refreshes that failed.",
+	})
+
+	sdTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "puppetdb_sd_targets",
+		Help: "Number of targets discovered per exporter.",
+	}, []string{"exporter"})
+
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "puppetdb_sd_last_success_timestamp_seconds",
+		Help: "Timestamp of the last refresh that completed without errors.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(refreshDuration, refreshFailures, sdTargets, lastSuccess)
+}
+
+// serveMetrics starts an HTTP server exposing prometheus-puppetdb's own metrics at /metrics
+func serveMetrics(listenAddress string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	fmt.Printf("Serving metrics on %s\n", listenAddress)
+	err := http.ListenAndServe(listenAddress, mux)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
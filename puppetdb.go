@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ResourceResult is the shape of a single row returned by PuppetDB's resources endpoint
+type ResourceResult struct {
+	Certname    string            `json:"certname"`
+	Resource    string            `json:"resource"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Exported    bool              `json:"exported"`
+	Tags        []string          `json:"tags"`
+	File        string            `json:"file"`
+	Environment string            `json:"environment"`
+	Parameters  map[string]string `json:"parameters"`
+}
+
+// FactResult is the shape of a single row returned by PuppetDB's facts endpoint
+type FactResult struct {
+	Certname string `json:"certname"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+// pqlEscape escapes a value for interpolation into a single-quoted PQL string literal
+func pqlEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return s
+}
+
+// pqlQuery marshals a PQL query string into a PuppetDB request body
+type pqlQuery struct {
+	Query string `json:"query"`
+}
+
+// queryPuppetDB POSTs a PQL query to PuppetDB's query/v4 endpoint and unmarshals the
+// result into out. It propagates non-200 responses as errors instead of attempting to
+// unmarshal an error body as if it were a successful result.
+func queryPuppetDB(client *http.Client, puppetdb string, query string, out interface{}) error {
+	body, err := json.Marshal(pqlQuery{Query: query})
+	if err != nil {
+		return err
+	}
+
+	puppetdbURL := fmt.Sprintf("%s/pdb/query/v4", puppetdb)
+	req, err := http.NewRequest("POST", puppetdbURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("puppetdb query failed with status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return json.Unmarshal(respBody, out)
+}
+
+// getNodesByFact discovers nodes via the `role` fact and, in a single PuppetDB query,
+// fetches addressFact plus labelFacts for each matching certname. addressFact becomes
+// the node's scrape address, labelFacts are carried on Node.Labels verbatim.
+func getNodesByFact(client *http.Client, puppetdb string, filter string, role string, addressFact string, labelFacts []string) (nodes []Node, err error) {
+	factNames := dedupeFactNames(addressFact, labelFacts)
+
+	nameClause := make([]string, len(factNames))
+	for i, name := range factNames {
+		nameClause[i] = fmt.Sprintf("name='%s'", pqlEscape(name))
+	}
+
+	q := fmt.Sprintf("facts[certname, name, value] {%s and (%s) and facts { name='role' and value='%s' } }", filter, strings.Join(nameClause, " or "), pqlEscape(role))
+
+	var facts []FactResult
+	err = queryPuppetDB(client, puppetdb, q, &facts)
+	if err != nil {
+		return
+	}
+
+	// Aggregate facts per certname before emitting nodes, so a node's address and every
+	// requested label fact end up in a single pass instead of one query per fact.
+	factsByCertname := make(map[string]map[string]string)
+	for _, fact := range facts {
+		if factsByCertname[fact.Certname] == nil {
+			factsByCertname[fact.Certname] = make(map[string]string)
+		}
+		factsByCertname[fact.Certname][fact.Name] = fact.Value
+	}
+
+	for certname, certFacts := range factsByCertname {
+		labels := make(map[string]string, len(labelFacts))
+		for _, name := range labelFacts {
+			labels[name] = certFacts[name]
+		}
+
+		nodes = append(nodes, Node{
+			Certname:  certname,
+			Ipaddress: certFacts[addressFact],
+			Labels:    labels,
+		})
+	}
+
+	return
+}
+
+// dedupeFactNames returns addressFact and labelFacts as a single deduplicated slice
+func dedupeFactNames(addressFact string, labelFacts []string) []string {
+	seen := map[string]bool{addressFact: true}
+	names := []string{addressFact}
+
+	for _, name := range labelFacts {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// getNodesByResource discovers nodes via PuppetDB's resources endpoint, matching on
+// resource type and title, and populates __meta_puppetdb_* labels analogous to
+// Prometheus's native puppetdb_sd_config. The resources endpoint carries no address, so
+// addressFact is looked up separately, in a single query, for every matched certname.
+func getNodesByResource(client *http.Client, puppetdb string, resourceType string, resourceTitle string, addressFact string) (nodes []Node, err error) {
+	q := fmt.Sprintf("resources[certname, resource, type, title, exported, tags, file, environment, parameters] {type='%s' and title='%s'}", pqlEscape(resourceType), pqlEscape(resourceTitle))
+
+	var resources []ResourceResult
+	err = queryPuppetDB(client, puppetdb, q, &resources)
+	if err != nil {
+		return
+	}
+
+	certnames := make([]string, len(resources))
+	for i, resource := range resources {
+		certnames[i] = resource.Certname
+	}
+
+	addresses, err := getFactByCertnames(client, puppetdb, addressFact, certnames)
+	if err != nil {
+		return
+	}
+
+	for _, resource := range resources {
+		meta := map[string]string{
+			"__meta_puppetdb_certname":    resource.Certname,
+			"__meta_puppetdb_resource":    resource.Resource,
+			"__meta_puppetdb_type":        resource.Type,
+			"__meta_puppetdb_title":       resource.Title,
+			"__meta_puppetdb_exported":    fmt.Sprintf("%t", resource.Exported),
+			"__meta_puppetdb_tags":        strings.Join(resource.Tags, ","),
+			"__meta_puppetdb_file":        resource.File,
+			"__meta_puppetdb_environment": resource.Environment,
+		}
+		for k, v := range resource.Parameters {
+			meta[fmt.Sprintf("__meta_puppetdb_parameter_%s", k)] = v
+		}
+
+		nodes = append(nodes, Node{
+			Certname:  resource.Certname,
+			Ipaddress: addresses[resource.Certname],
+			Meta:      meta,
+		})
+	}
+
+	return
+}
+
+// getFactByCertnames fetches a single fact for a set of certnames in one PuppetDB query,
+// returning a map of certname to fact value. Certnames with no matching fact are simply
+// absent from the result.
+func getFactByCertnames(client *http.Client, puppetdb string, factName string, certnames []string) (map[string]string, error) {
+	values := make(map[string]string, len(certnames))
+	if len(certnames) == 0 {
+		return values, nil
+	}
+
+	certnameClause := make([]string, len(certnames))
+	for i, certname := range certnames {
+		certnameClause[i] = fmt.Sprintf("'%s'", pqlEscape(certname))
+	}
+
+	q := fmt.Sprintf("facts[certname, name, value] {name='%s' and certname in [%s]}", pqlEscape(factName), strings.Join(certnameClause, ", "))
+
+	var facts []FactResult
+	if err := queryPuppetDB(client, puppetdb, q, &facts); err != nil {
+		return nil, err
+	}
+
+	for _, fact := range facts {
+		values[fact.Certname] = fact.Value
+	}
+
+	return values, nil
+}
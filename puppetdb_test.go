@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPqlEscape(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"webserver", "webserver"},
+		{`o'brien`, `o\'brien`},
+		{`back\slash`, `back\\slash`},
+		{`quote'd\path`, `quote\'d\\path`},
+		{"日本語", "日本語"},
+	}
+
+	for _, c := range cases {
+		if got := pqlEscape(c.in); got != c.want {
+			t.Errorf("pqlEscape(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// decodedQuery round-trips the request body PuppetDB would have received and returns the
+// PQL query string, failing the test if the body isn't valid JSON.
+func decodedQuery(t *testing.T, r *http.Request) string {
+	t.Helper()
+	var body pqlQuery
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Fatalf("request body is not valid JSON: %v", err)
+	}
+	return body.Query
+}
+
+func TestGetNodesByFact_EscapesRoleName(t *testing.T) {
+	roles := []string{`web"server`, `o'brien`, `back\slash`, "日本語"}
+
+	for _, role := range roles {
+		var gotQuery string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = decodedQuery(t, r)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[]`))
+		}))
+
+		_, err := getNodesByFact(http.DefaultClient, server.URL, "nodes { deactivated is null }", role, "ipaddress", nil)
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("getNodesByFact(role=%q) returned error: %v", role, err)
+		}
+		if !strings.Contains(gotQuery, pqlEscape(role)) {
+			t.Errorf("query %q does not contain escaped role %q", gotQuery, pqlEscape(role))
+		}
+	}
+}
+
+func TestGetNodesByFact_EmptyResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	nodes, err := getNodesByFact(http.DefaultClient, server.URL, "nodes { deactivated is null }", "webserver", "ipaddress", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("expected no nodes, got %d", len(nodes))
+	}
+}
+
+func TestGetNodesByFact_NonOKStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"boom"}`))
+	}))
+	defer server.Close()
+
+	_, err := getNodesByFact(http.DefaultClient, server.URL, "nodes { deactivated is null }", "webserver", "ipaddress", nil)
+	if err == nil {
+		t.Fatal("expected an error for a non-200 response, got nil")
+	}
+	if !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected error to mention the status code, got: %v", err)
+	}
+}
+
+func TestGetNodesByFact_MalformedJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`not json`))
+	}))
+	defer server.Close()
+
+	_, err := getNodesByFact(http.DefaultClient, server.URL, "nodes { deactivated is null }", "webserver", "ipaddress", nil)
+	if err == nil {
+		t.Fatal("expected an error for a malformed response body, got nil")
+	}
+}
+
+func TestGetNodesByResource_EscapesTitle(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = decodedQuery(t, r)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	title := `node-exporter's "prod"`
+	_, err := getNodesByResource(http.DefaultClient, server.URL, "Package", title, "ipaddress")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(gotQuery, pqlEscape(title)) {
+		t.Errorf("query %q does not contain escaped title %q", gotQuery, pqlEscape(title))
+	}
+}
+
+func TestGetNodesByResource_PopulatesAddress(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch requests {
+		case 0:
+			w.Write([]byte(`[{"certname":"web1.example.com","resource":"Package[node-exporter]","type":"Package","title":"node-exporter"}]`))
+		case 1:
+			if !strings.Contains(decodedQuery(t, r), "web1.example.com") {
+				t.Errorf("address lookup query missing discovered certname: %q", decodedQuery(t, r))
+			}
+			w.Write([]byte(`[{"certname":"web1.example.com","name":"ipaddress","value":"10.0.0.1"}]`))
+		}
+		requests++
+	}))
+	defer server.Close()
+
+	nodes, err := getNodesByResource(http.DefaultClient, server.URL, "Package", "node-exporter", "ipaddress")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d", len(nodes))
+	}
+	if nodes[0].Ipaddress != "10.0.0.1" {
+		t.Errorf("Ipaddress = %q, want %q", nodes[0].Ipaddress, "10.0.0.1")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RelabelConfig mirrors the subset of Prometheus's relabel_config semantics that are
+// useful for deriving/filtering labels from a target's labels before it is written out:
+// job, certname, metrics_path and scheme, the label_facts fetched by getNodesByFact, and
+// the __meta_puppetdb_* labels populated by getNodesByResource.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+const (
+	relabelDefaultSeparator   = ";"
+	relabelDefaultRegex       = "(.*)"
+	relabelDefaultReplacement = "$1"
+	relabelDefaultAction      = "replace"
+)
+
+// applyRelabelConfigs runs labels through a chain of RelabelConfigs, Prometheus-style.
+// It returns the resulting label set and whether the target should be kept.
+func applyRelabelConfigs(labels map[string]string, configs []RelabelConfig) (map[string]string, bool, error) {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+
+	for _, cfg := range configs {
+		keep, err := relabel(out, cfg)
+		if err != nil {
+			return out, false, err
+		}
+		if !keep {
+			return out, false, nil
+		}
+	}
+
+	return out, true, nil
+}
+
+func relabel(labels map[string]string, cfg RelabelConfig) (bool, error) {
+	separator := cfg.Separator
+	if separator == "" {
+		separator = relabelDefaultSeparator
+	}
+
+	regexStr := cfg.Regex
+	if regexStr == "" {
+		regexStr = relabelDefaultRegex
+	}
+
+	action := cfg.Action
+	if action == "" {
+		action = relabelDefaultAction
+	}
+
+	replacement := cfg.Replacement
+	if replacement == "" {
+		replacement = relabelDefaultReplacement
+	}
+
+	re, err := regexp.Compile("^(?:" + regexStr + ")$")
+	if err != nil {
+		return false, err
+	}
+
+	switch action {
+	case "labeldrop":
+		for name := range labels {
+			if re.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+		return true, nil
+
+	case "labelkeep":
+		for name := range labels {
+			if !re.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+		return true, nil
+
+	case "labelmap":
+		// Collect renamed entries into a separate map before merging, rather than
+		// mutating labels while ranging over it: Go leaves the visibility of entries
+		// inserted mid-range undefined, so renaming in place can cascade into a
+		// self-matching regex re-matching its own output.
+		renamed := make(map[string]string)
+		for name, value := range labels {
+			if match := re.FindStringSubmatchIndex(name); match != nil {
+				renamed[string(re.ExpandString(nil, replacement, name, match))] = value
+			}
+		}
+		for name, value := range renamed {
+			labels[name] = value
+		}
+		return true, nil
+	}
+
+	values := make([]string, len(cfg.SourceLabels))
+	for i, label := range cfg.SourceLabels {
+		values[i] = labels[label]
+	}
+	value := strings.Join(values, separator)
+
+	switch action {
+	case "keep":
+		return re.MatchString(value), nil
+
+	case "drop":
+		return !re.MatchString(value), nil
+
+	case "replace":
+		match := re.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true, nil
+		}
+		if cfg.TargetLabel != "" {
+			labels[cfg.TargetLabel] = string(re.ExpandString(nil, replacement, value, match))
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unknown relabel action %q", action)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestRelabel_LabelMap(t *testing.T) {
+	labels := map[string]string{
+		"k1": "v1",
+		"k2": "v2",
+	}
+
+	keep, err := relabel(labels, RelabelConfig{
+		Action:      "labelmap",
+		Regex:       "(.*)",
+		Replacement: "pref_$1",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !keep {
+		t.Fatal("expected labelmap to keep the target")
+	}
+
+	want := map[string]string{
+		"k1":      "v1",
+		"k2":      "v2",
+		"pref_k1": "v1",
+		"pref_k2": "v2",
+	}
+	for name, value := range want {
+		if got := labels[name]; got != value {
+			t.Errorf("labels[%q] = %q, want %q", name, got, value)
+		}
+	}
+	for name := range labels {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected label %q = %q (a self-matching regex must not cascade)", name, labels[name])
+		}
+	}
+}
+
+func TestRelabel_LabelDrop(t *testing.T) {
+	labels := map[string]string{
+		"__meta_puppetdb_certname": "web1.example.com",
+		"job":                      "node-exporter",
+	}
+
+	keep, err := relabel(labels, RelabelConfig{
+		Action: "labeldrop",
+		Regex:  "__meta_puppetdb_.*",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !keep {
+		t.Fatal("expected labeldrop to keep the target")
+	}
+	if _, ok := labels["__meta_puppetdb_certname"]; ok {
+		t.Error("expected __meta_puppetdb_certname to be dropped")
+	}
+	if _, ok := labels["job"]; !ok {
+		t.Error("expected job to remain")
+	}
+}
+
+func TestRelabel_LabelKeep(t *testing.T) {
+	labels := map[string]string{
+		"__meta_puppetdb_certname": "web1.example.com",
+		"job":                      "node-exporter",
+	}
+
+	keep, err := relabel(labels, RelabelConfig{
+		Action: "labelkeep",
+		Regex:  "__meta_puppetdb_.*",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !keep {
+		t.Fatal("expected labelkeep to keep the target")
+	}
+	if _, ok := labels["job"]; ok {
+		t.Error("expected job to be dropped")
+	}
+	if _, ok := labels["__meta_puppetdb_certname"]; !ok {
+		t.Error("expected __meta_puppetdb_certname to remain")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Targets struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// writtenHashes tracks the sha256 of the last content written per Exporter, so the
+// targets file is only rewritten when the resolved set actually changes.
+var writtenHashes = struct {
+	sync.Mutex
+	hashes map[string][32]byte
+}{hashes: make(map[string][32]byte)}
+
+// Iterate through the yml & yaml files in TargetsDir and remove all that do not match an Exporter in roleMapping
+func cleanupTargetsDir(dir string, roles []RoleMapping) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+OUTER:
+	for _, file := range files {
+		for r := range roles {
+			found, _ := regexp.MatchString(fmt.Sprintf("%s.(yaml|yml)", roles[r].Exporter), file.Name())
+			if found {
+				continue OUTER
+			}
+		}
+
+		err = os.Remove(fmt.Sprintf("%s/%s", dir, file.Name()))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	return
+}
+
+// buildTargets turns the discovered nodes for an Exporter into File SD / HTTP SD target groups.
+// When relabelConfigs is non-empty, it is evaluated per-target and may drop the target or
+// rewrite its labels; a relabel_config that sets __address__ overrides the scrape address
+// built from node.Ipaddress and port, same as Prometheus's own relabeling. __meta_puppetdb_*
+// labels (and __address__) are stripped from the final output once relabeling has run, same
+// as Prometheus does for its own meta-labels.
+func buildTargets(nodes []Node, port int, path string, scheme string, job string, relabelConfigs []RelabelConfig) ([]Targets, error) {
+	allTargets := []Targets{}
+
+	// Nodes discovered via getNodesByFact arrive in Go's randomized map iteration order,
+	// which would otherwise make the marshaled output (and its sha256 in writeNodes)
+	// change between refreshes even when the underlying target set hasn't. Sort by
+	// certname so the output is deterministic.
+	nodes = append([]Node(nil), nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Certname < nodes[j].Certname })
+
+	for _, node := range nodes {
+		labels := map[string]string{
+			"job":          job,
+			"certname":     node.Certname,
+			"metrics_path": path,
+			"scheme":       scheme,
+		}
+		for k, v := range node.Meta {
+			labels[k] = v
+		}
+		for k, v := range node.Labels {
+			labels[k] = v
+		}
+
+		address := fmt.Sprintf("%s:%v", node.Ipaddress, port)
+
+		if len(relabelConfigs) > 0 {
+			var keep bool
+			var err error
+			labels, keep, err = applyRelabelConfigs(labels, relabelConfigs)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+			// Prometheus-style: a relabel_config targeting __address__ overrides the
+			// scrape address, and is popped out before the __-prefixed meta-labels are
+			// stripped so it doesn't leak into the final label set.
+			if addr, ok := labels["__address__"]; ok {
+				address = addr
+			}
+			for name := range labels {
+				if strings.HasPrefix(name, "__") {
+					delete(labels, name)
+				}
+			}
+		}
+
+		targets := Targets{
+			Targets: []string{address},
+			Labels:  labels,
+		}
+		allTargets = append(allTargets, targets)
+	}
+
+	return allTargets, nil
+}
+
+func writeNodes(nodes []Node, port int, path string, scheme string, job string, dir string, relabelConfigs []RelabelConfig) (err error) {
+	allTargets, err := buildTargets(nodes, port, path, scheme, job, relabelConfigs)
+	if err != nil {
+		return
+	}
+
+	d, err := yaml.Marshal(&allTargets)
+	if err != nil {
+		return
+	}
+
+	hash := sha256.Sum256(d)
+	targetFile := fmt.Sprintf("%s/%s.yml", dir, job)
+
+	writtenHashes.Lock()
+	unchanged := writtenHashes.hashes[job] == hash
+	writtenHashes.Unlock()
+	if unchanged {
+		// The resolved set matches what we last wrote, but the file itself may have
+		// disappeared since (volume reset, operator cleanup, a transient
+		// cleanupTargetsDir pass) — only skip the write if it's still on disk.
+		if _, statErr := os.Stat(targetFile); statErr == nil {
+			return nil
+		}
+	}
+
+	os.MkdirAll(fmt.Sprintf("%s", dir), 0755)
+	err = writeFileAtomic(dir, fmt.Sprintf("%s.yml", job), d)
+	if err != nil {
+		return
+	}
+
+	writtenHashes.Lock()
+	writtenHashes.hashes[job] = hash
+	writtenHashes.Unlock()
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in dir and renames it into place, so
+// Prometheus's file_sd inotify watch never observes a truncated/partial file.
+func writeFileAtomic(dir string, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf(".%s.tmp-*", name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fmt.Sprintf("%s/%s", dir, name))
+}
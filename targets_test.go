@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestBuildTargets_DeterministicOrder guards against buildTargets producing output whose
+// order (and therefore marshaled hash) depends on the iteration order of the map built by
+// getNodesByFact, which Go randomizes per run.
+func TestBuildTargets_DeterministicOrder(t *testing.T) {
+	nodes := []Node{
+		{Certname: "web3.example.com", Ipaddress: "10.0.0.3"},
+		{Certname: "web1.example.com", Ipaddress: "10.0.0.1"},
+		{Certname: "web2.example.com", Ipaddress: "10.0.0.2"},
+	}
+
+	first, err := buildTargets(nodes, 9100, "/metrics", "http", "node-exporter", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d, err := yaml.Marshal(&first)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling targets: %v", err)
+	}
+	want := sha256.Sum256(d)
+
+	for i := 0; i < 20; i++ {
+		// Feed the same nodes in a different (rotated) order each run
+		rotated := append(append([]Node(nil), nodes[i%len(nodes):]...), nodes[:i%len(nodes)]...)
+		got, err := buildTargets(rotated, 9100, "/metrics", "http", "node-exporter", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d, err := yaml.Marshal(&got)
+		if err != nil {
+			t.Fatalf("unexpected error marshaling targets: %v", err)
+		}
+		if sha256.Sum256(d) != want {
+			t.Fatalf("buildTargets produced a different hash on run %d for the same logical input", i)
+		}
+	}
+}
+
+// TestBuildTargets_RelabelAddress verifies that a relabel_config targeting __address__
+// overrides the scrape address, Prometheus-style, instead of being silently discarded by
+// the __-prefixed meta-label strip.
+func TestBuildTargets_RelabelAddress(t *testing.T) {
+	nodes := []Node{
+		{
+			Certname: "web1.example.com",
+			Meta:     map[string]string{"__meta_puppetdb_fqdn": "web1.internal.example.com"},
+		},
+	}
+	relabelConfigs := []RelabelConfig{
+		{
+			SourceLabels: []string{"__meta_puppetdb_fqdn"},
+			TargetLabel:  "__address__",
+			Regex:        "(.+)",
+			Replacement:  "$1:9100",
+		},
+	}
+
+	targets, err := buildTargets(nodes, 9100, "/metrics", "http", "node-exporter", relabelConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 target, got %d", len(targets))
+	}
+	if want := "web1.internal.example.com:9100"; targets[0].Targets[0] != want {
+		t.Errorf("Targets[0] = %q, want %q", targets[0].Targets[0], want)
+	}
+	if _, ok := targets[0].Labels["__address__"]; ok {
+		t.Error("expected __address__ to be stripped from the final labels")
+	}
+}
+
+// TestWriteNodes_RecreatesDeletedFile guards against the skip-if-unchanged hash check
+// trusting stale in-memory state when the target file has disappeared from disk (volume
+// reset, operator cleanup, a transient cleanupTargetsDir pass) — the file must be
+// recreated even though the resolved node set hasn't changed.
+func TestWriteNodes_RecreatesDeletedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometheus-puppetdb-targets")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	job := "recreate-test-exporter"
+	nodes := []Node{{Certname: "web1.example.com", Ipaddress: "10.0.0.1"}}
+
+	if err := writeNodes(nodes, 9100, "/metrics", "http", job, dir, nil); err != nil {
+		t.Fatalf("unexpected error on first write: %v", err)
+	}
+
+	targetFile := fmt.Sprintf("%s/%s.yml", dir, job)
+	if _, err := os.Stat(targetFile); err != nil {
+		t.Fatalf("expected %s to exist after first write: %v", targetFile, err)
+	}
+
+	if err := os.Remove(targetFile); err != nil {
+		t.Fatalf("unexpected error removing target file: %v", err)
+	}
+
+	if err := writeNodes(nodes, 9100, "/metrics", "http", job, dir, nil); err != nil {
+		t.Fatalf("unexpected error on second write: %v", err)
+	}
+
+	if _, err := os.Stat(targetFile); err != nil {
+		t.Errorf("expected %s to be recreated after external deletion, but it's missing: %v", targetFile, err)
+	}
+}